@@ -0,0 +1,121 @@
+package main
+
+import (
+  "bufio"
+  "crypto/sha1"
+  "encoding/base64"
+  "fmt"
+  "log"
+  "net"
+  "net/http"
+  "os"
+  "strings"
+
+  "golang.org/x/crypto/bcrypt"
+)
+
+// htpasswdFile is a parsed htpasswd-style credentials file mapping
+// usernames to their hashed password, supporting bcrypt ($2a$/$2b$/$2y$)
+// and SHA1 ({SHA}base64) hashes.
+type htpasswdFile map[string]string
+
+// loadHtpasswd reads an htpasswd-style file of "user:hash" lines, ignoring
+// blank lines and "#"-prefixed comments.
+func loadHtpasswd(path string) (htpasswdFile, error) {
+  file, error := os.Open(path)
+  if error != nil {
+    return nil, error
+  }
+  defer file.Close()
+
+  credentials := htpasswdFile{}
+  scanner := bufio.NewScanner(file)
+  for scanner.Scan() {
+    line := strings.TrimSpace(scanner.Text())
+    if line == "" || strings.HasPrefix(line, "#") {
+      continue
+    }
+    parts := strings.SplitN(line, ":", 2)
+    if len(parts) == 2 {
+      credentials[parts[0]] = parts[1]
+    }
+  }
+  return credentials, scanner.Err()
+}
+
+// authenticate reports whether username/password match the stored hash,
+// supporting both bcrypt and legacy {SHA}-prefixed SHA1 htpasswd entries.
+func (credentials htpasswdFile) authenticate(username string, password string) bool {
+  hash, found := credentials[username]
+  if !found {
+    return false
+  }
+  if strings.HasPrefix(hash, "{SHA}") {
+    sum := sha1.Sum([]byte(password))
+    return hash == "{SHA}"+base64.StdEncoding.EncodeToString(sum[:])
+  }
+  return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
+
+// requireBasicAuth wraps handler so that every request must present HTTP
+// Basic credentials matching an entry in credentials, responding 401 with a
+// WWW-Authenticate challenge otherwise.
+func requireBasicAuth(handler http.HandlerFunc, credentials htpasswdFile) http.HandlerFunc {
+  return func(w http.ResponseWriter, r *http.Request) {
+    username, password, ok := r.BasicAuth()
+    if !ok || !credentials.authenticate(username, password) {
+      w.Header().Set("WWW-Authenticate", `Basic realm="MarkUp"`)
+      w.WriteHeader(http.StatusUnauthorized)
+      fmt.Fprint(w, "Unauthorized")
+      return
+    }
+    handler(w, r)
+  }
+}
+
+// requireReadonlyAllowlist wraps handler so that non-GET/HEAD requests are
+// only accepted from clients whose address falls within one of allowed's
+// CIDR blocks. GET and HEAD requests always pass through, as does every
+// request when allowed is empty; this is preparation for future write
+// endpoints rather than a restriction on today's (read-only) ones.
+func requireReadonlyAllowlist(handler http.HandlerFunc, allowed []*net.IPNet) http.HandlerFunc {
+  return func(w http.ResponseWriter, r *http.Request) {
+    if r.Method == http.MethodGet || r.Method == http.MethodHead || len(allowed) == 0 {
+      handler(w, r)
+      return
+    }
+
+    host, _, error := net.SplitHostPort(r.RemoteAddr)
+    if error != nil {
+      host = r.RemoteAddr
+    }
+    ip := net.ParseIP(host)
+    for _, block := range allowed {
+      if ip != nil && block.Contains(ip) {
+        handler(w, r)
+        return
+      }
+    }
+
+    w.WriteHeader(http.StatusForbidden)
+    fmt.Fprint(w, "Forbidden")
+  }
+}
+
+// parseCIDRList parses a comma-separated list of CIDR blocks, as accepted
+// by -readonly-ips.
+func parseCIDRList(list string) []*net.IPNet {
+  var blocks []*net.IPNet
+  for _, entry := range strings.Split(list, ",") {
+    entry = strings.TrimSpace(entry)
+    if entry == "" {
+      continue
+    }
+    _, block, error := net.ParseCIDR(entry)
+    if error != nil {
+      log.Fatalf("Error: invalid CIDR block (\"%s\") in -readonly-ips", entry)
+    }
+    blocks = append(blocks, block)
+  }
+  return blocks
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+  "testing"
+
+  "golang.org/x/crypto/bcrypt"
+)
+
+func TestHtpasswdFileAuthenticate(t *testing.T) {
+  hash, error := bcrypt.GenerateFromPassword([]byte("swordfish"), bcrypt.MinCost)
+  if error != nil {
+    t.Fatalf("bcrypt.GenerateFromPassword: %v", error)
+  }
+
+  credentials := htpasswdFile{
+    "alice": string(hash),
+    "bob":   "{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=", // {SHA} of "secret"
+  }
+
+  cases := []struct {
+    name     string
+    username string
+    password string
+    want     bool
+  }{
+    {"correct bcrypt password", "alice", "swordfish", true},
+    {"wrong bcrypt password", "alice", "wrong", false},
+    {"correct legacy SHA password", "bob", "secret", true},
+    {"wrong legacy SHA password", "bob", "wrong", false},
+    {"unknown user", "carol", "anything", false},
+  }
+
+  for _, testCase := range cases {
+    t.Run(testCase.name, func(t *testing.T) {
+      if got := credentials.authenticate(testCase.username, testCase.password); got != testCase.want {
+        t.Errorf("authenticate(%q, %q) = %v, want %v", testCase.username, testCase.password, got, testCase.want)
+      }
+    })
+  }
+}
+
+func TestParseCIDRList(t *testing.T) {
+  blocks := parseCIDRList("127.0.0.1/32, 10.0.0.0/8")
+  if len(blocks) != 2 {
+    t.Fatalf("parseCIDRList returned %d blocks, want 2", len(blocks))
+  }
+  if blocks[0].String() != "127.0.0.1/32" {
+    t.Errorf("blocks[0] = %q, want %q", blocks[0].String(), "127.0.0.1/32")
+  }
+  if blocks[1].String() != "10.0.0.0/8" {
+    t.Errorf("blocks[1] = %q, want %q", blocks[1].String(), "10.0.0.0/8")
+  }
+}
+
+func TestParseCIDRListEmpty(t *testing.T) {
+  if blocks := parseCIDRList(""); len(blocks) != 0 {
+    t.Errorf("parseCIDRList(\"\") = %v, want no blocks", blocks)
+  }
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+  "container/list"
+  "crypto/sha256"
+  "encoding/hex"
+  "net/http"
+  "sync"
+  "time"
+)
+
+// cacheEntry holds a rendered document together with enough of the source
+// file's metadata to detect staleness without re-reading it, plus a strong
+// ETag used for conditional GETs.
+type cacheEntry struct {
+  path    string
+  html    []byte
+  modTime time.Time
+  size    int64
+  etag    string
+}
+
+// renderCache is a concurrency-safe, size-bounded LRU cache of rendered
+// Markdown keyed by the absolute source path. It lets handleFile skip
+// re-reading and re-parsing a file when neither its size nor its mtime has
+// changed since the last request. A capacity of zero disables retention:
+// put still computes the ETag needed for the response headers but keeps
+// nothing around, so every request is a miss.
+type renderCache struct {
+  mutex    sync.Mutex
+  capacity int
+  entries  map[string]*list.Element
+  order    *list.List
+}
+
+func newRenderCache(capacity int) *renderCache {
+  return &renderCache{
+    capacity: capacity,
+    entries:  map[string]*list.Element{},
+    order:    list.New(),
+  }
+}
+
+// get returns the cached entry for path if present and still fresh given
+// the source file's current mtime and size, promoting it to
+// most-recently-used.
+func (c *renderCache) get(path string, modTime time.Time, size int64) (cacheEntry, bool) {
+  c.mutex.Lock()
+  defer c.mutex.Unlock()
+
+  element, found := c.entries[path]
+  if !found {
+    return cacheEntry{}, false
+  }
+  entry := element.Value.(cacheEntry)
+  if !entry.modTime.Equal(modTime) || entry.size != size {
+    return cacheEntry{}, false
+  }
+  c.order.MoveToFront(element)
+  return entry, true
+}
+
+// put computes the ETag for html and, unless the cache is disabled, stores
+// (or replaces) the entry for path, evicting the least-recently-used entry
+// if the cache is at capacity.
+func (c *renderCache) put(path string, html []byte, modTime time.Time, size int64) cacheEntry {
+  entry := cacheEntry{path: path, html: html, modTime: modTime, size: size, etag: computeETag(html)}
+  if c.capacity <= 0 {
+    return entry
+  }
+
+  c.mutex.Lock()
+  defer c.mutex.Unlock()
+
+  if element, found := c.entries[path]; found {
+    element.Value = entry
+    c.order.MoveToFront(element)
+    return entry
+  }
+
+  c.entries[path] = c.order.PushFront(entry)
+  for len(c.entries) > c.capacity {
+    oldest := c.order.Back()
+    if oldest == nil {
+      break
+    }
+    c.order.Remove(oldest)
+    delete(c.entries, oldest.Value.(cacheEntry).path)
+  }
+  return entry
+}
+
+// computeETag returns a strong ETag (hex-encoded SHA-256) for rendered HTML.
+func computeETag(html []byte) string {
+  sum := sha256.Sum256(html)
+  return hex.EncodeToString(sum[:])
+}
+
+// notModified reports whether r's conditional request headers indicate the
+// client's cached copy of entry is still current, honoring If-None-Match in
+// preference to If-Modified-Since as recommended by RFC 7232.
+func notModified(r *http.Request, entry cacheEntry) bool {
+  if match := r.Header.Get("If-None-Match"); match != "" {
+    return match == `"`+entry.etag+`"`
+  }
+  if since := r.Header.Get("If-Modified-Since"); since != "" {
+    if t, error := http.ParseTime(since); error == nil {
+      return !entry.modTime.Truncate(time.Second).After(t)
+    }
+  }
+  return false
+}
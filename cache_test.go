@@ -0,0 +1,99 @@
+package main
+
+import (
+  "net/http"
+  "net/http/httptest"
+  "testing"
+  "time"
+)
+
+func TestRenderCacheGetPut(t *testing.T) {
+  cache := newRenderCache(2)
+  modTime := time.Now()
+
+  if _, found := cache.get("/a.md", modTime, 10); found {
+    t.Fatalf("get on empty cache returned a hit")
+  }
+
+  cache.put("/a.md", []byte("<p>a</p>"), modTime, 10)
+  entry, found := cache.get("/a.md", modTime, 10)
+  if !found {
+    t.Fatalf("get did not find entry just put")
+  }
+  if string(entry.html) != "<p>a</p>" {
+    t.Errorf("entry.html = %q, want %q", entry.html, "<p>a</p>")
+  }
+
+  if _, found := cache.get("/a.md", modTime.Add(time.Second), 10); found {
+    t.Errorf("get returned a hit for a changed mtime")
+  }
+  if _, found := cache.get("/a.md", modTime, 11); found {
+    t.Errorf("get returned a hit for a changed size")
+  }
+}
+
+func TestRenderCacheEvictsLeastRecentlyUsed(t *testing.T) {
+  cache := newRenderCache(2)
+  modTime := time.Now()
+
+  cache.put("/a.md", []byte("a"), modTime, 1)
+  cache.put("/b.md", []byte("b"), modTime, 1)
+  cache.get("/a.md", modTime, 1) // touch a so b becomes the LRU entry
+  cache.put("/c.md", []byte("c"), modTime, 1)
+
+  if _, found := cache.get("/b.md", modTime, 1); found {
+    t.Errorf("least-recently-used entry /b.md was not evicted")
+  }
+  if _, found := cache.get("/a.md", modTime, 1); !found {
+    t.Errorf("recently-used entry /a.md was evicted")
+  }
+  if _, found := cache.get("/c.md", modTime, 1); !found {
+    t.Errorf("just-inserted entry /c.md is missing")
+  }
+}
+
+func TestRenderCacheDisabled(t *testing.T) {
+  cache := newRenderCache(0)
+  modTime := time.Now()
+
+  entry := cache.put("/a.md", []byte("a"), modTime, 1)
+  if entry.etag == "" {
+    t.Errorf("put on a disabled cache did not compute an ETag")
+  }
+  if _, found := cache.get("/a.md", modTime, 1); found {
+    t.Errorf("get on a disabled cache returned a hit")
+  }
+}
+
+func TestNotModified(t *testing.T) {
+  entry := cacheEntry{modTime: time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC), etag: computeETag([]byte("x"))}
+
+  matching := httptest.NewRequest(http.MethodGet, "/a.md", nil)
+  matching.Header.Set("If-None-Match", `"`+entry.etag+`"`)
+  if !notModified(matching, entry) {
+    t.Errorf("notModified = false for a matching If-None-Match")
+  }
+
+  stale := httptest.NewRequest(http.MethodGet, "/a.md", nil)
+  stale.Header.Set("If-None-Match", `"deadbeef"`)
+  if notModified(stale, entry) {
+    t.Errorf("notModified = true for a mismatched If-None-Match")
+  }
+
+  sinceFresh := httptest.NewRequest(http.MethodGet, "/a.md", nil)
+  sinceFresh.Header.Set("If-Modified-Since", entry.modTime.Format(http.TimeFormat))
+  if !notModified(sinceFresh, entry) {
+    t.Errorf("notModified = false when If-Modified-Since equals entry.modTime")
+  }
+
+  sinceStale := httptest.NewRequest(http.MethodGet, "/a.md", nil)
+  sinceStale.Header.Set("If-Modified-Since", entry.modTime.Add(-time.Hour).Format(http.TimeFormat))
+  if notModified(sinceStale, entry) {
+    t.Errorf("notModified = true when If-Modified-Since predates entry.modTime")
+  }
+
+  none := httptest.NewRequest(http.MethodGet, "/a.md", nil)
+  if notModified(none, entry) {
+    t.Errorf("notModified = true with no conditional headers")
+  }
+}
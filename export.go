@@ -0,0 +1,230 @@
+package main
+
+import (
+  "archive/zip"
+  "bytes"
+  "fmt"
+  "html"
+  "io"
+  "log"
+  "net/http"
+  "os/exec"
+  "path/filepath"
+  "regexp"
+  "strings"
+)
+
+// Exporter renders an already-converted HTML fragment into a downloadable
+// document format, writing the result directly to w.
+type Exporter interface {
+  // Export writes the exported document for the given title and rendered
+  // HTML body to w.
+  Export(w io.Writer, title string, body []byte, opts options) error
+  // ContentType is the MIME type to send with the exported document.
+  ContentType() string
+  // Extension is the file extension (including the leading dot) used to
+  // build the Content-Disposition filename.
+  Extension() string
+}
+
+// exportersFor returns the exporters enabled by opts.export, keyed by the
+// `?export=` query value that selects them.
+func exportersFor(opts options) map[string]Exporter {
+  exporters := map[string]Exporter{}
+  for _, format := range strings.Split(opts.export, ",") {
+    switch strings.TrimSpace(format) {
+    case "pdf":
+      exporters["pdf"] = pdfExporter{binary: opts.pdfBinary}
+    case "epub":
+      exporters["epub"] = epubExporter{}
+    }
+  }
+  return exporters
+}
+
+// handleExport serves the rendered document as a PDF or EPUB download when
+// the request carries a recognised `?export=` query parameter. It returns
+// true if it handled the request (successfully or not), false if the
+// request carried no `export` parameter and the caller should render the
+// normal HTML page instead.
+func handleExport(w http.ResponseWriter, r *http.Request, title string, body []byte, opts options) bool {
+  format := r.URL.Query().Get("export")
+  if format == "" {
+    return false
+  }
+
+  exporter, enabled := exportersFor(opts)[format]
+  if !enabled {
+    handleError(w, r.URL.Path, opts)
+    return true
+  }
+
+  filename := strings.TrimSuffix(filepath.Base(title), opts.extension) + exporter.Extension()
+  w.Header().Set("Content-Type", exporter.ContentType())
+  w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+  if error := exporter.Export(w, title, body, opts); error != nil {
+    log.Printf("Error: export of %s as %s failed: %v", title, format, error)
+  }
+  return true
+}
+
+// ---- PDF export ----
+
+// pdfExporter shells out to an external binary that reads a standalone
+// HTML document on stdin and writes a PDF to stdout, using wkhtmltopdf's
+// "-q - -" (quiet, read stdin, write stdout) convention. -pdf-binary may
+// point at any drop-in replacement honoring that same convention; a
+// renderer with a different CLI (e.g. Chromium's headless printer, which
+// takes a URL/file rather than stdin) needs a small wrapper script in front
+// of it.
+type pdfExporter struct {
+  binary string
+}
+
+func (e pdfExporter) ContentType() string { return "application/pdf" }
+func (e pdfExporter) Extension() string   { return ".pdf" }
+
+func (e pdfExporter) Export(w io.Writer, title string, body []byte, opts options) error {
+  cmd := exec.Command(e.binary, "-q", "-", "-")
+  cmd.Stdin = bytes.NewReader(wrapExportHTML(title, body, opts))
+  cmd.Stdout = w
+
+  var stderr bytes.Buffer
+  cmd.Stderr = &stderr
+
+  if error := cmd.Run(); error != nil {
+    return fmt.Errorf("%s: %v: %s", e.binary, error, strings.TrimSpace(stderr.String()))
+  }
+  return nil
+}
+
+// wrapExportHTML assembles a standalone HTML document, stylesheet (and any
+// Chroma syntax-highlighting CSS) inlined, since the PDF renderer is handed
+// a byte stream rather than a URL it could follow a <link> from.
+func wrapExportHTML(title string, body []byte, opts options) []byte {
+  return []byte(fmt.Sprintf("<!DOCTYPE html><html><head><title>%s</title><style>%s</style></head><body>%s</body></html>",
+    html.EscapeString(title), staticStylesheet()+opts.highlightCSS, body))
+}
+
+// ---- EPUB export ----
+
+// epubExporter assembles a minimal EPUB 2 container around the rendered
+// HTML body: a single XHTML document referenced by content.opf and toc.ncx.
+type epubExporter struct{}
+
+func (e epubExporter) ContentType() string { return "application/epub+zip" }
+func (e epubExporter) Extension() string   { return ".epub" }
+
+const epubContainerXML = `<?xml version="1.0" encoding="UTF-8"?>
+<container version="1.0" xmlns="urn:oasis:names:tc:opendocument:xmlns:container">
+  <rootfiles>
+    <rootfile full-path="content.opf" media-type="application/oebps-package+xml"/>
+  </rootfiles>
+</container>`
+
+const epubContentOPF = `<?xml version="1.0" encoding="UTF-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="2.0" unique-identifier="BookId">
+  <metadata xmlns:dc="http://purl.org/dc/elements/1.1/">
+    <dc:title>%[1]s</dc:title>
+    <dc:language>en</dc:language>
+    <dc:identifier id="BookId">markup:%[1]s</dc:identifier>
+  </metadata>
+  <manifest>
+    <item id="document" href="document.xhtml" media-type="application/xhtml+xml"/>
+    <item id="ncx" href="toc.ncx" media-type="application/x-dtbncx+xml"/>
+  </manifest>
+  <spine toc="ncx">
+    <itemref idref="document"/>
+  </spine>
+</package>`
+
+const epubTocNCX = `<?xml version="1.0" encoding="UTF-8"?>
+<ncx xmlns="http://www.daisy.org/z3986/2005/ncx/" version="2005-1">
+  <head></head>
+  <docTitle><text>%[1]s</text></docTitle>
+  <navMap>
+    <navPoint id="document" playOrder="1">
+      <navLabel><text>%[1]s</text></navLabel>
+      <content src="document.xhtml"/>
+    </navPoint>
+  </navMap>
+</ncx>`
+
+const epubXHTML = `<?xml version="1.0" encoding="UTF-8"?>
+<html xmlns="http://www.w3.org/1999/xhtml">
+<head><title>%s</title></head>
+<body>%s</body>
+</html>`
+
+func (e epubExporter) Export(w io.Writer, title string, body []byte, opts options) error {
+  archive := zip.NewWriter(w)
+
+  write := func(name string, method uint16, content string) error {
+    entry, error := archive.CreateHeader(&zip.FileHeader{Name: name, Method: method})
+    if error != nil {
+      return error
+    }
+    _, error = entry.Write([]byte(content))
+    return error
+  }
+
+  escapedTitle := html.EscapeString(title)
+  if error := write("mimetype", zip.Store, "application/epub+zip"); error != nil {
+    return error
+  }
+  if error := write("META-INF/container.xml", zip.Deflate, epubContainerXML); error != nil {
+    return error
+  }
+  if error := write("content.opf", zip.Deflate, fmt.Sprintf(epubContentOPF, escapedTitle)); error != nil {
+    return error
+  }
+  if error := write("toc.ncx", zip.Deflate, fmt.Sprintf(epubTocNCX, escapedTitle)); error != nil {
+    return error
+  }
+  if error := write("document.xhtml", zip.Deflate, fmt.Sprintf(epubXHTML, escapedTitle, xhtmlSanitize(body))); error != nil {
+    return error
+  }
+
+  return archive.Close()
+}
+
+// xhtmlEntityReplacer rewrites the named HTML entities blackfriday's
+// HTML_USE_SMARTYPANTS emits (curly quotes, dashes, ellipses, (c)/(r)/(tm)
+// symbols and 1/2, 1/4, 3/4 fractions) into their
+// numeric equivalents: unlike HTML, XML has no built-in named entities
+// beyond amp/lt/gt/quot/apos, so &ldquo; etc. would leave document.xhtml
+// not well-formed and rejected by conforming EPUB readers.
+var xhtmlEntityReplacer = strings.NewReplacer(
+  "&ldquo;", "&#8220;",
+  "&rdquo;", "&#8221;",
+  "&lsquo;", "&#8216;",
+  "&rsquo;", "&#8217;",
+  "&mdash;", "&#8212;",
+  "&ndash;", "&#8211;",
+  "&hellip;", "&#8230;",
+  "&nbsp;", "&#160;",
+  "&copy;", "&#169;",
+  "&reg;", "&#174;",
+  "&trade;", "&#8482;",
+  "&frac12;", "&#189;",
+  "&frac14;", "&#188;",
+  "&frac34;", "&#190;",
+)
+
+// voidTag matches the void elements blackfriday emits unclosed (<br>,
+// <hr>, <img ...>), which XML requires to be self-closed.
+var voidTag = regexp.MustCompile(`<(br|hr|img)((?:\s+[^>]*)?)\s*/?>`)
+
+// xhtmlSanitize rewrites a blackfriday HTML fragment into well-formed XML
+// suitable for embedding in an EPUB's XHTML document.
+func xhtmlSanitize(body []byte) []byte {
+  escaped := xhtmlEntityReplacer.Replace(string(body))
+  return voidTag.ReplaceAllFunc([]byte(escaped), func(match []byte) []byte {
+    groups := voidTag.FindSubmatch(match)
+    name, attrs := string(groups[1]), strings.TrimRight(string(groups[2]), " /")
+    if attrs == "" {
+      return []byte(fmt.Sprintf("<%s/>", name))
+    }
+    return []byte(fmt.Sprintf("<%s %s/>", name, attrs))
+  })
+}
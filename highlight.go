@@ -0,0 +1,85 @@
+package main
+
+import (
+  "bytes"
+  "html"
+  "regexp"
+
+  "github.com/alecthomas/chroma"
+  chromahtml "github.com/alecthomas/chroma/formatters/html"
+  "github.com/alecthomas/chroma/lexers"
+  "github.com/alecthomas/chroma/styles"
+)
+
+// fencedCodeBlock matches the <pre><code class="language-XXX">...</code></pre>
+// blocks blackfriday emits for EXTENSION_FENCED_CODE, as well as the bare
+// <pre><code>...</code></pre> it emits for a fence with no language hint
+// (the class attribute is only present when a hint was given).
+var fencedCodeBlock = regexp.MustCompile(`(?s)<pre><code(?: class="language-([^"]*)")?>(.*?)</code></pre>`)
+
+// highlightCode replaces blackfriday's plain fenced code blocks with
+// server-side syntax highlighting via Chroma, using the fence's language
+// hint when present and falling back to Chroma's content analyser when the
+// language is unknown or missing. Blocks Chroma can't lex are left as-is.
+func highlightCode(rendered []byte, style string) []byte {
+  return fencedCodeBlock.ReplaceAllFunc(rendered, func(match []byte) []byte {
+    groups := fencedCodeBlock.FindSubmatch(match)
+    language := string(groups[1])
+    code := html.UnescapeString(string(groups[2]))
+
+    lexer := lexerFor(language, code)
+    if lexer == nil {
+      return match
+    }
+
+    iterator, error := lexer.Tokenise(nil, code)
+    if error != nil {
+      return match
+    }
+
+    var out bytes.Buffer
+    formatter := chromahtml.New(chromahtml.WithClasses(true))
+    if error := formatter.Format(&out, styleFor(style), iterator); error != nil {
+      return match
+    }
+    return out.Bytes()
+  })
+}
+
+// lexerFor resolves the Chroma lexer for a fenced code block's language
+// hint, falling back to content analysis when the hint is empty or
+// unrecognised.
+func lexerFor(language string, code string) chroma.Lexer {
+  var lexer chroma.Lexer
+  if language != "" {
+    lexer = lexers.Get(language)
+  }
+  if lexer == nil {
+    lexer = lexers.Analyse(code)
+  }
+  if lexer == nil {
+    return nil
+  }
+  return chroma.Coalesce(lexer)
+}
+
+// styleFor resolves a Chroma style by name, falling back to Chroma's
+// default style when the name is unrecognised.
+func styleFor(name string) *chroma.Style {
+  if style := styles.Get(name); style != nil {
+    return style
+  }
+  return styles.Fallback
+}
+
+// highlightStylesheet renders the Chroma CSS for the given style, computed
+// once at startup and concatenated onto the built-in stylesheet rather than
+// shipped inline on every page.
+func highlightStylesheet(style string) string {
+  var out bytes.Buffer
+  formatter := chromahtml.New(chromahtml.WithClasses(true))
+  if error := formatter.WriteCSS(&out, styleFor(style)); error != nil {
+    return ""
+  }
+  return out.String()
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+  "strings"
+  "testing"
+)
+
+func TestFencedCodeBlockMatchesUnlabeledBlocks(t *testing.T) {
+  cases := []struct {
+    name     string
+    input    string
+    language string
+  }{
+    {"labeled block", `<pre><code class="language-go">func f() {}</code></pre>`, "go"},
+    {"unlabeled block", `<pre><code>func f() {}</code></pre>`, ""},
+  }
+
+  for _, testCase := range cases {
+    t.Run(testCase.name, func(t *testing.T) {
+      match := fencedCodeBlock.FindStringSubmatch(testCase.input)
+      if match == nil {
+        t.Fatalf("fencedCodeBlock did not match %q", testCase.input)
+      }
+      if match[1] != testCase.language {
+        t.Errorf("language = %q, want %q", match[1], testCase.language)
+      }
+    })
+  }
+}
+
+func TestHighlightCodeFallsBackToAnalyserForUnlabeledBlocks(t *testing.T) {
+  rendered := []byte(`<pre><code>package main
+
+func main() {
+	println(&quot;hi&quot;)
+}
+</code></pre>`)
+
+  out := string(highlightCode(rendered, "github"))
+  if strings.Contains(out, "<pre><code>") {
+    t.Fatalf("unlabeled fenced block was left unhighlighted: %q", out)
+  }
+  if !strings.Contains(out, "chroma") {
+    t.Errorf("highlighted output missing Chroma's chroma class: %q", out)
+  }
+}
+
+func TestLexerForFallsBackToAnalyser(t *testing.T) {
+  if lexerFor("go", "func f() {}") == nil {
+    t.Errorf("lexerFor did not resolve a lexer for a recognised language hint")
+  }
+  if lexerFor("not-a-real-language", "package main\n\nfunc main() {}\n") == nil {
+    t.Errorf("lexerFor did not fall back to content analysis for an unrecognised hint")
+  }
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+  "fmt"
+  "log"
+  "net/http"
+  "os"
+  "path/filepath"
+  "strings"
+  "sync"
+  "time"
+
+  "github.com/fsnotify/fsnotify"
+)
+
+// liveReloadPath is the URL path live-reload clients connect to for
+// Server-Sent Events announcing changed Markdown files.
+const liveReloadPath = "/events"
+
+// liveReloader watches opts.root for changes to Markdown files and fans the
+// affected URL path out to every connected SSE client.
+type liveReloader struct {
+  opts    options
+  mutex   sync.Mutex
+  clients map[chan string]bool
+}
+
+func newLiveReloader(opts options) *liveReloader {
+  return &liveReloader{opts: opts, clients: map[chan string]bool{}}
+}
+
+// start creates the filesystem watcher, adds opts.root (and, when
+// opts.recursive is set, every subdirectory whose own name does not start
+// with a dot) to it, and runs the event loop
+// in the background. It only returns an error if the watcher itself could
+// not be created; failing to watch an individual subdirectory is logged
+// and otherwise ignored.
+func (lr *liveReloader) start() error {
+  watcher, err := fsnotify.NewWatcher()
+  if err != nil {
+    return err
+  }
+
+  addDir := func(dir string) {
+    if error := watcher.Add(dir); error != nil {
+      log.Printf("Error: could not watch %s for changes: %v", dir, error)
+    }
+  }
+
+  addDir(lr.opts.root)
+  if lr.opts.recursive {
+    filepath.Walk(lr.opts.root, func(file string, finfo os.FileInfo, error error) error {
+      if error == nil && finfo.IsDir() && file != lr.opts.root && !strings.HasPrefix(finfo.Name(), ".") {
+        addDir(file)
+      }
+      return nil
+    })
+  }
+
+  go lr.run(watcher, addDir)
+  return nil
+}
+
+// run is the watcher's event loop. Editor saves commonly emit several
+// filesystem events for the same file in quick succession (write-to-temp,
+// rename, chmod, ...); debounce coalesces those into a single broadcast.
+func (lr *liveReloader) run(watcher *fsnotify.Watcher, addDir func(string)) {
+  var debounceMutex sync.Mutex
+  pending := map[string]*time.Timer{}
+
+  debounce := func(urlPath string) {
+    debounceMutex.Lock()
+    defer debounceMutex.Unlock()
+    if timer, scheduled := pending[urlPath]; scheduled {
+      timer.Stop()
+    }
+    pending[urlPath] = time.AfterFunc(100*time.Millisecond, func() {
+      debounceMutex.Lock()
+      delete(pending, urlPath)
+      debounceMutex.Unlock()
+      lr.broadcast(urlPath)
+    })
+  }
+
+  for {
+    select {
+    case event, open := <-watcher.Events:
+      if !open {
+        return
+      }
+
+      stat, statError := os.Stat(event.Name)
+      if statError != nil {
+        // The path is gone; if it used to be a watched directory fsnotify
+        // will keep complaining about it otherwise, so drop the watch.
+        watcher.Remove(event.Name)
+        if strings.EqualFold(filepath.Ext(event.Name), lr.opts.extension) {
+          debounce(lr.urlPath(event.Name))
+        }
+        continue
+      }
+      if stat.IsDir() {
+        if lr.opts.recursive && event.Op&fsnotify.Create != 0 {
+          addDir(event.Name)
+        }
+        continue
+      }
+      if strings.EqualFold(filepath.Ext(event.Name), lr.opts.extension) {
+        debounce(lr.urlPath(event.Name))
+      }
+    case error, open := <-watcher.Errors:
+      if !open {
+        return
+      }
+      log.Printf("Error: filesystem watcher: %v", error)
+    }
+  }
+}
+
+func (lr *liveReloader) urlPath(path string) string {
+  return filepath.ToSlash(strings.TrimPrefix(path, lr.opts.root))
+}
+
+// broadcast pushes urlPath to every connected client, dropping it for any
+// client whose buffer is already full rather than blocking the watcher.
+func (lr *liveReloader) broadcast(urlPath string) {
+  lr.mutex.Lock()
+  defer lr.mutex.Unlock()
+  for client := range lr.clients {
+    select {
+    case client <- urlPath:
+    default:
+    }
+  }
+}
+
+func (lr *liveReloader) subscribe() chan string {
+  client := make(chan string, 8)
+  lr.mutex.Lock()
+  lr.clients[client] = true
+  lr.mutex.Unlock()
+  return client
+}
+
+func (lr *liveReloader) unsubscribe(client chan string) {
+  lr.mutex.Lock()
+  delete(lr.clients, client)
+  lr.mutex.Unlock()
+  close(client)
+}
+
+// handleEvents serves /events as a text/event-stream, pushing the URL path
+// of every changed Markdown file to connected clients.
+func (lr *liveReloader) handleEvents(w http.ResponseWriter, r *http.Request) {
+  flusher, ok := w.(http.Flusher)
+  if !ok {
+    http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+    return
+  }
+
+  w.Header().Set("Content-Type", "text/event-stream")
+  w.Header().Set("Cache-Control", "no-cache")
+  w.Header().Set("Connection", "keep-alive")
+
+  client := lr.subscribe()
+  defer lr.unsubscribe(client)
+
+  for {
+    select {
+    case urlPath, open := <-client:
+      if !open {
+        return
+      }
+      fmt.Fprintf(w, "data: %s\n\n", urlPath)
+      flusher.Flush()
+    case <-r.Context().Done():
+      return
+    }
+  }
+}
+
+// liveReloadScript is injected into every rendered page when -live is
+// enabled. It subscribes to /events and reloads the current page when the
+// event's path matches it.
+func liveReloadScript() string {
+  return fmt.Sprintf(`<script>
+(function() {
+  var source = new EventSource(%q);
+  source.onmessage = function(event) {
+    if (event.data === window.location.pathname) {
+      window.location.reload();
+    }
+  };
+})();
+</script>`, liveReloadPath)
+}
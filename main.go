@@ -4,6 +4,7 @@ import (
   "flag"
   "fmt"
   "github.com/russross/blackfriday"
+  "golang.org/x/crypto/acme/autocert"
   "html"
   "io/ioutil"
   "log"
@@ -15,22 +16,92 @@ import (
 
 type (
   options struct {
-    root       string
-    port       uint
-    recursive  bool
-    stylesheet string
-    extension  string
+    root              string
+    port              uint
+    recursive         bool
+    stylesheet        string
+    extension         string
+    math              string
+    export            string
+    pdfBinary         string
+    cacheMode         string
+    cacheSize         int
+    cache             *renderCache
+    live              bool
+    highlight         string
+    highlightStyle    string
+    highlightCSS      string
+    authFile          string
+    tlsCert           string
+    tlsKey            string
+    tlsAutocertDomain string
+    tlsAutocertDir    string
+    readonlyIPs       string
   }
 )
 
 func main() {
   opts := parseArguments()
 
+  cacheSize := opts.cacheSize
+  if opts.cacheMode == "off" {
+    cacheSize = 0
+  }
+  opts.cache = newRenderCache(cacheSize)
+
+  if opts.highlight == "on" {
+    opts.highlightCSS = highlightStylesheet(opts.highlightStyle)
+  }
+
+  var credentials htpasswdFile
+  if opts.authFile != "" {
+    var error error
+    credentials, error = loadHtpasswd(opts.authFile)
+    if error != nil {
+      log.Fatalf("Error: could not read the auth file: %s", opts.authFile)
+    }
+  }
+  protect := func(handler http.HandlerFunc) http.HandlerFunc {
+    if opts.authFile != "" {
+      handler = requireBasicAuth(handler, credentials)
+    }
+    return handler
+  }
+
+  if opts.live {
+    reloader := newLiveReloader(opts)
+    if error := reloader.start(); error != nil {
+      log.Fatalf("Error: could not watch %s for changes: %v", opts.root, error)
+    }
+    http.HandleFunc(liveReloadPath, protect(reloader.handleEvents))
+  }
+
+  root := handle(opts)
+  if opts.readonlyIPs != "" {
+    root = requireReadonlyAllowlist(root, parseCIDRList(opts.readonlyIPs))
+  }
+  http.HandleFunc("/", protect(root))
+
   log.Printf("Starting server at port (%d) and root (%s)\n", opts.port, opts.root)
   log.Printf("Press CTRL-C to terminate\n")
 
-  http.HandleFunc("/", handle(opts))
-  error := http.ListenAndServe(fmt.Sprintf(":%d", opts.port), nil)
+  server := &http.Server{Addr: fmt.Sprintf(":%d", opts.port)}
+
+  var error error
+  switch {
+  case opts.tlsAutocertDomain != "":
+    manager := &autocert.Manager{
+      Prompt:     autocert.AcceptTOS,
+      HostPolicy: autocert.HostWhitelist(opts.tlsAutocertDomain),
+      Cache:      autocert.DirCache(opts.tlsAutocertDir),
+    }
+    server.TLSConfig = manager.TLSConfig()
+    error = server.ListenAndServeTLS("", "")
+  case opts.tlsCert != "":
+    error = server.ListenAndServeTLS(opts.tlsCert, opts.tlsKey)
+  default:
+    error = server.ListenAndServe()
+  }
   if error != nil {
     log.Fatal("Error: could not listen at ", opts.port)
   }
@@ -45,6 +116,20 @@ func parseArguments() options {
   flag.BoolVar(&opts.recursive, "recursive", true, "allow serving Markdown documents within the subdirectories of the root")
   flag.StringVar(&opts.stylesheet, "stylesheet", staticStylesheetName(), "stylesheet to use when rendering Markdown files")
   flag.StringVar(&opts.extension, "extension", ".md", "extension identifying the Markdown files")
+  flag.StringVar(&opts.math, "math", "off", "math rendering: off, katex or mathjax")
+  flag.StringVar(&opts.export, "export", "pdf,epub", "enabled export formats (comma-separated: pdf, epub) or \"off\" to disable")
+  flag.StringVar(&opts.pdfBinary, "pdf-binary", "wkhtmltopdf", "binary used to render PDF exports (must accept \"-\" for stdin and stdout)")
+  flag.StringVar(&opts.cacheMode, "cache", "memory", "server-side render cache: off or memory")
+  flag.IntVar(&opts.cacheSize, "cache-size", 256, "maximum number of rendered documents kept in the cache")
+  flag.BoolVar(&opts.live, "live", false, "watch the root folder and live-reload pages in the browser on change")
+  flag.StringVar(&opts.highlight, "highlight", "on", "syntax highlighting for fenced code blocks: on or off")
+  flag.StringVar(&opts.highlightStyle, "highlight-style", "github", "Chroma style used for syntax highlighting")
+  flag.StringVar(&opts.authFile, "auth-file", "", "htpasswd-style file (bcrypt or SHA) requiring HTTP Basic auth when set")
+  flag.StringVar(&opts.tlsCert, "tls-cert", "", "TLS certificate file (use together with -tls-key)")
+  flag.StringVar(&opts.tlsKey, "tls-key", "", "TLS private key file (use together with -tls-cert)")
+  flag.StringVar(&opts.tlsAutocertDomain, "tls-autocert", "", "domain to request a Let's Encrypt certificate for via autocert")
+  flag.StringVar(&opts.tlsAutocertDir, "tls-autocert-dir", ".autocert-cache", "directory autocert caches certificates in")
+  flag.StringVar(&opts.readonlyIPs, "readonly-ips", "", "comma-separated CIDR blocks allowed to use non-GET methods")
   flag.Usage = func() {
     fmt.Fprintln(os.Stderr, "MarkUp: a tiny Markdown server")
     fmt.Fprintln(os.Stderr, "Usage:")
@@ -75,23 +160,42 @@ func parseArguments() options {
   if !strings.HasPrefix(opts.extension, ".") {
     log.Fatalf("Error: the extension (\"%s\") should start with a dot", opts.extension)
   }
+
+  if opts.math != "off" && opts.math != "katex" && opts.math != "mathjax" {
+    log.Fatalf("Error: the math mode (\"%s\") should be one of: off, katex, mathjax", opts.math)
+  }
+
+  if opts.cacheMode != "off" && opts.cacheMode != "memory" {
+    log.Fatalf("Error: the cache mode (\"%s\") should be one of: off, memory", opts.cacheMode)
+  }
+
+  if opts.highlight != "on" && opts.highlight != "off" {
+    log.Fatalf("Error: the highlight mode (\"%s\") should be one of: on, off", opts.highlight)
+  }
+
+  if (opts.tlsCert == "") != (opts.tlsKey == "") {
+    log.Fatalf("Error: -tls-cert and -tls-key must both be set")
+  }
+  if opts.tlsAutocertDomain != "" && opts.tlsCert != "" {
+    log.Fatalf("Error: -tls-autocert cannot be combined with -tls-cert/-tls-key")
+  }
   return opts
 }
 
 // Handle all incoming requests.
 func handle(opts options) func(http.ResponseWriter, *http.Request) {
   return func(w http.ResponseWriter, r *http.Request) {
-    if !handleStaticResource(w, r) {
+    if !handleStaticResource(w, r, opts) {
       urlPath := r.URL.Path
       path := filepath.FromSlash(filepath.Clean(opts.root + "/" + urlPath))
 
       stat, error := os.Stat(path)
       if error != nil {
-        handleError(w, urlPath)
+        handleError(w, urlPath, opts)
       } else if stat.IsDir() {
         handleDir(w, path, urlPath, opts)
       } else {
-        handleFile(w, path, urlPath, opts)
+        handleFile(w, r, path, urlPath, opts)
       }
     }
   }
@@ -105,63 +209,116 @@ func handle(opts options) func(http.ResponseWriter, *http.Request) {
 // without introspecting their content.
 func handleDir(w http.ResponseWriter, path string, urlPath string, opts options) {
   addLink := func(w http.ResponseWriter, url string, label string) {
-    fmt.Fprintf(w, "<a href=\"%s\"><tt>%s</tt></a><br>", url, label)
+    fmt.Fprintf(w, "<a href=\"%s\"><tt>%s</tt></a>", url, label)
   }
   addRelativeLink := func(w http.ResponseWriter, path string, name string) {
     addLink(w, strings.TrimPrefix(path, opts.root), name)
   }
+  addExportLinks := func(w http.ResponseWriter, path string) {
+    relative := strings.TrimPrefix(path, opts.root)
+    for _, format := range []string{"pdf", "epub"} {
+      if _, enabled := exportersFor(opts)[format]; enabled {
+        fmt.Fprintf(w, ` <a href="%s?export=%s"><tt>%s</tt></a>`, relative, format, strings.ToUpper(format))
+      }
+    }
+  }
   walker := func(file string, finfo os.FileInfo, error error) error {
     if error != nil {
-      handleError(w, urlPath)
+      handleError(w, urlPath, opts)
       return error
     }
     if finfo.IsDir() && file != path {
       if opts.recursive && !strings.HasPrefix(finfo.Name(), ".") { // ignore dot files
         addRelativeLink(w, file, finfo.Name()+"/") // signal directories with a trailing slash
+        fmt.Fprint(w, "<br>")
       }
       return filepath.SkipDir // add links only for the files within the current directory
     }
     if strings.EqualFold(filepath.Ext(file), opts.extension) { // add links only for the Markdown files
       addRelativeLink(w, file, finfo.Name())
+      addExportLinks(w, file)
+      fmt.Fprint(w, "<br>")
     }
     return nil
   }
 
-  writePageStart(w, urlPath)
+  writePageStart(w, urlPath, opts)
   filepath.Walk(path, walker)
   writePageEnd(w)
 }
 
 // Handle requests for Markdown files.
 //
-// Currently markdown files are read and rendered for each request. The rendered
-// Markdown is not cached on disk or in memory server-side (beyond the Operating
-// System's file cache). Additionally, browser-side caching is not enabled
-// (for example using ETags based on the file's modified date).
-func handleFile(w http.ResponseWriter, path string, urlPath string, opts options) {
+// Rendered Markdown is kept in opts.cache, keyed by the source file's
+// absolute path and invalidated by mtime/size, so a file is only re-read
+// and re-parsed when it actually changed. Each rendered page carries an ETag
+// and Last-Modified header (`?export=` downloads do not); a matching
+// If-None-Match/If-Modified-Since yields a bodyless 304 instead of the full
+// page.
+func handleFile(w http.ResponseWriter, r *http.Request, path string, urlPath string, opts options) {
   // ignore any file without the Markdown extension
   if !strings.EqualFold(filepath.Ext(path), opts.extension) {
-    handleError(w, urlPath)
+    handleError(w, urlPath, opts)
     return
   }
 
-  file, error := os.Open(path)
+  stat, error := os.Stat(path)
   if error != nil {
-    handleError(w, urlPath)
+    handleError(w, urlPath, opts)
     return
   }
-  defer file.Close()
 
-  content, error := ioutil.ReadAll(file)
-  if error != nil {
-    handleError(w, urlPath)
+  entry, cached := opts.cache.get(path, stat.ModTime(), stat.Size())
+  if !cached {
+    file, error := os.Open(path)
+    if error != nil {
+      handleError(w, urlPath, opts)
+      return
+    }
+    content, error := ioutil.ReadAll(file)
+    file.Close()
+    if error != nil {
+      handleError(w, urlPath, opts)
+      return
+    }
+
+    entry = opts.cache.put(path, renderMarkdown(content, urlPath, opts), stat.ModTime(), stat.Size())
+  }
+
+  if handleExport(w, r, urlPath, entry.html, opts) {
+    return
+  }
+
+  w.Header().Set("ETag", `"`+entry.etag+`"`)
+  w.Header().Set("Last-Modified", entry.modTime.UTC().Format(http.TimeFormat))
+  if notModified(r, entry) {
+    w.WriteHeader(http.StatusNotModified)
     return
   }
 
-  var rendererOptions = blackfriday.HTML_COMPLETE_PAGE|blackfriday.HTML_USE_SMARTYPANTS
+  writePageStart(w, urlPath, opts)
+  w.Write(entry.html)
+  writePageEnd(w)
+}
+
+// renderMarkdown converts raw Markdown bytes into the HTML fragment served
+// inside the page body (or embedded into a PDF/EPUB export), applying the
+// math pre/post-processing pipeline along the way.
+func renderMarkdown(content []byte, urlPath string, opts options) []byte {
+  // Math spans are pulled out before blackfriday ever sees the document:
+  // blackfriday's own escaping of `_`, `^`, `\` and `$` would otherwise
+  // mangle formulas. They are stitched back into the rendered HTML below.
+  content, spans := extractMath(content)
+
+  var rendererOptions = blackfriday.HTML_USE_SMARTYPANTS
   var renderer = blackfriday.HtmlRenderer(rendererOptions, urlPath, opts.stylesheet)
   var enabledExtensions = blackfriday.EXTENSION_AUTOLINK|blackfriday.EXTENSION_FENCED_CODE|blackfriday.EXTENSION_STRIKETHROUGH
-  w.Write(blackfriday.Markdown(content, renderer, enabledExtensions))
+  body := injectMath(blackfriday.Markdown(content, renderer, enabledExtensions), spans)
+
+  if opts.highlight == "on" {
+    body = highlightCode(body, opts.highlightStyle)
+  }
+  return body
 }
 
 // Handle read errors.
@@ -170,9 +327,9 @@ func handleFile(w http.ResponseWriter, path string, urlPath string, opts options
 // actual read error (e.g. the file does not exist, the file path points to
 // a directory, the file is not a Markdown file or the current user does
 // not have read permissions on the file)
-func handleError(w http.ResponseWriter, urlPath string) {
+func handleError(w http.ResponseWriter, urlPath string, opts options) {
   w.WriteHeader(http.StatusNotFound)
-  writePageStart(w, "File not found")
+  writePageStart(w, "File not found", opts)
   fmt.Fprintf(w, "File not found: %s", urlPath)
   writePageEnd(w)
 }
@@ -181,10 +338,10 @@ func handleError(w http.ResponseWriter, urlPath string) {
 //
 // Currently the only built-in static resource is
 // a CSS stylesheet to style the rendered Markdown.
-func handleStaticResource(w http.ResponseWriter, r *http.Request) bool {
+func handleStaticResource(w http.ResponseWriter, r *http.Request, opts options) bool {
   if r.URL.Path == staticStylesheetName() {
     writeHeaders(w, "text/css")
-    fmt.Fprintf(w, staticStylesheet())
+    fmt.Fprint(w, staticStylesheet()+opts.highlightCSS)
     return true
   }
 
@@ -195,9 +352,14 @@ func writeHeaders(w http.ResponseWriter, contentType string) {
   w.Header().Set("Content-Type", contentType)
 }
 
-func writePageStart(w http.ResponseWriter, title string) {
+func writePageStart(w http.ResponseWriter, title string, opts options) {
   writeHeaders(w, "text/html")
-  fmt.Fprintf(w, "<!DOCTYPE html><html><head><title>%s</title></head><body>", html.EscapeString(title))
+  script := ""
+  if opts.live {
+    script = liveReloadScript()
+  }
+  fmt.Fprintf(w, "<!DOCTYPE html><html><head><title>%s</title><link rel=\"stylesheet\" href=\"%s\">%s%s</head><body>",
+    html.EscapeString(title), opts.stylesheet, mathHeadTags(opts.math), script)
 }
 
 func writePageEnd(w http.ResponseWriter) {
@@ -0,0 +1,238 @@
+package main
+
+import (
+  "bytes"
+  "fmt"
+  "html"
+)
+
+// mathSpan records a math expression pulled out of the raw Markdown source
+// before it reaches blackfriday, so that `_`, `^`, `\` and `$` inside the
+// expression survive Markdown's own escaping instead of being mangled.
+type mathSpan struct {
+  source  string
+  display bool
+}
+
+const mathPlaceholder = "\x00MATH%d\x00"
+
+// extractMath scans raw Markdown bytes for `$$...$$` (display) and `$...$`
+// (inline) math spans, replacing each with a placeholder token and
+// returning the rewritten content together with the spans it removed, in
+// the order they appear.
+//
+// Display spans are matched first and may span multiple lines. Inline spans
+// must stay on a single line, must not be preceded by a backslash (so
+// `\$5\$` is left untouched) and, mirroring Pandoc's rule for `$...$`, their
+// content may not be empty or start/end with whitespace. Fenced code blocks
+// and inline code spans are passed through verbatim: per the same Pandoc
+// rule, a `$` inside code is never math.
+func extractMath(content []byte) ([]byte, []mathSpan) {
+  var spans []mathSpan
+  var out bytes.Buffer
+
+  placeholder := func(span mathSpan) string {
+    index := len(spans)
+    spans = append(spans, span)
+    return fmt.Sprintf(mathPlaceholder, index)
+  }
+
+  i := 0
+  for i < len(content) {
+    if end, ok := skipFencedCodeBlock(content, i); ok {
+      out.Write(content[i:end])
+      i = end
+      continue
+    }
+    if content[i] == '`' {
+      if end, ok := skipCodeSpan(content, i); ok {
+        out.Write(content[i:end])
+        i = end
+        continue
+      }
+    }
+    if content[i] == '\\' && i+1 < len(content) && content[i+1] == '$' {
+      out.WriteByte(content[i])
+      out.WriteByte(content[i+1])
+      i += 2
+      continue
+    }
+    if content[i] != '$' {
+      out.WriteByte(content[i])
+      i++
+      continue
+    }
+    if i+1 < len(content) && content[i+1] == '$' {
+      if end := bytes.Index(content[i+2:], []byte("$$")); end >= 0 {
+        inner := string(content[i+2 : i+2+end])
+        out.WriteString(placeholder(mathSpan{source: inner, display: true}))
+        i = i + 2 + end + 2
+        continue
+      }
+    } else if end, ok := findInlineMath(content, i); ok {
+      inner := string(content[i+1 : end])
+      out.WriteString(placeholder(mathSpan{source: inner, display: false}))
+      i = end + 1
+      continue
+    }
+    out.WriteByte('$')
+    i++
+  }
+
+  return out.Bytes(), spans
+}
+
+// skipFencedCodeBlock reports whether a Markdown fenced code block (a line
+// starting, after up to 3 spaces of indentation, with a run of 3+ backticks
+// or tildes) begins at content[i], which must itself be the start of a
+// line. If so it returns the offset just past the block, including its
+// closing fence (or end of input, if the fence is never closed).
+func skipFencedCodeBlock(content []byte, i int) (int, bool) {
+  if i != 0 && content[i-1] != '\n' {
+    return 0, false
+  }
+
+  lineEnd := lineEndAt(content, i)
+  indent := leadingSpaces(content[i:lineEnd])
+  if indent > 3 {
+    return 0, false
+  }
+  fenceStart := i + indent
+  if fenceStart >= lineEnd {
+    return 0, false
+  }
+  fenceChar := content[fenceStart]
+  if fenceChar != '`' && fenceChar != '~' {
+    return 0, false
+  }
+  fenceLen := 0
+  for fenceStart+fenceLen < lineEnd && content[fenceStart+fenceLen] == fenceChar {
+    fenceLen++
+  }
+  if fenceLen < 3 {
+    return 0, false
+  }
+
+  pos := lineEnd
+  if pos < len(content) {
+    pos++ // past the newline
+  }
+  for pos <= len(content) {
+    end := lineEndAt(content, pos)
+    line := content[pos:end]
+    trimmed := bytes.TrimSpace(line)
+    if leadingSpaces(line) <= 3 && len(trimmed) >= fenceLen && len(trimmed) == bytes.Count(trimmed, []byte{fenceChar}) {
+      if end < len(content) {
+        end++
+      }
+      return end, true
+    }
+    if end >= len(content) {
+      return len(content), true
+    }
+    pos = end + 1
+  }
+  return len(content), true
+}
+
+// skipCodeSpan reports whether an inline code span starts at content[i]
+// (itself a backtick). Per CommonMark, a run of N backticks opens a span
+// that is closed by the next run of exactly N backticks; an unterminated
+// run is not a code span.
+func skipCodeSpan(content []byte, i int) (int, bool) {
+  openLen := 0
+  for i+openLen < len(content) && content[i+openLen] == '`' {
+    openLen++
+  }
+
+  pos := i + openLen
+  for pos < len(content) {
+    if content[pos] != '`' {
+      pos++
+      continue
+    }
+    runLen := 0
+    for pos+runLen < len(content) && content[pos+runLen] == '`' {
+      runLen++
+    }
+    if runLen == openLen {
+      return pos + runLen, true
+    }
+    pos += runLen
+  }
+  return 0, false
+}
+
+func lineEndAt(content []byte, from int) int {
+  if idx := bytes.IndexByte(content[from:], '\n'); idx >= 0 {
+    return from + idx
+  }
+  return len(content)
+}
+
+func leadingSpaces(line []byte) int {
+  n := 0
+  for n < len(line) && line[n] == ' ' {
+    n++
+  }
+  return n
+}
+
+// findInlineMath looks for the closing `$` of an inline math span starting
+// at content[start] (itself a `$`). It refuses to match across a newline
+// and rejects spans whose content is empty or starts/ends with whitespace.
+func findInlineMath(content []byte, start int) (int, bool) {
+  for j := start + 1; j < len(content); j++ {
+    if content[j] == '\n' {
+      return 0, false
+    }
+    if content[j] == '\\' {
+      j++
+      continue
+    }
+    if content[j] == '$' {
+      inner := content[start+1 : j]
+      if len(inner) == 0 || inner[0] == ' ' || inner[0] == '\t' || inner[len(inner)-1] == ' ' || inner[len(inner)-1] == '\t' {
+        return 0, false
+      }
+      return j, true
+    }
+  }
+  return 0, false
+}
+
+// injectMath walks blackfriday's rendered HTML and substitutes each math
+// placeholder left by extractMath with an escaped `<span class="math ...">`
+// that the client-side KaTeX/MathJax script picks up.
+func injectMath(rendered []byte, spans []mathSpan) []byte {
+  out := rendered
+  for index, span := range spans {
+    token := []byte(fmt.Sprintf(mathPlaceholder, index))
+    class, delimited := "inline", "\\("+span.source+"\\)"
+    if span.display {
+      class, delimited = "display", "\\["+span.source+"\\]"
+    }
+    replacement := []byte(fmt.Sprintf(`<span class="math %s">%s</span>`, class, html.EscapeString(delimited)))
+    out = bytes.Replace(out, token, replacement, 1)
+  }
+  return out
+}
+
+// mathHeadTags returns the <link>/<script> tags that must be injected into
+// the page <head> so the client-side renderer picks up the `span.math`
+// elements emitted by injectMath. Returns the empty string when math
+// rendering is disabled.
+func mathHeadTags(mode string) string {
+  switch mode {
+  case "katex":
+    return `<link rel="stylesheet" href="https://cdn.jsdelivr.net/npm/katex@0/dist/katex.min.css">` +
+      `<script defer src="https://cdn.jsdelivr.net/npm/katex@0/dist/katex.min.js"></script>` +
+      `<script defer src="https://cdn.jsdelivr.net/npm/katex@0/dist/contrib/auto-render.min.js" ` +
+      `onload="renderMathInElement(document.body, {delimiters: [{left: '\\[', right: '\\]', display: true}, {left: '\\(', right: '\\)', display: false}]});"></script>`
+  case "mathjax":
+    return `<script>window.MathJax = {tex: {inlineMath: [['\\(', '\\)']], displayMath: [['\\[', '\\]']]}};</script>` +
+      `<script defer src="https://cdn.jsdelivr.net/npm/mathjax@3/es5/tex-mml-chtml.js"></script>`
+  default:
+    return ""
+  }
+}
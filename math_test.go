@@ -0,0 +1,117 @@
+package main
+
+import (
+  "strings"
+  "testing"
+)
+
+func TestExtractMath(t *testing.T) {
+  cases := []struct {
+    name     string
+    input    string
+    want     string
+    sources  []string
+    displays []bool
+  }{
+    {
+      name:  "inline math",
+      input: "price is $5 + 2$ today",
+      want:  "price is \x00MATH0\x00 today",
+      sources: []string{"5 + 2"},
+      displays: []bool{false},
+    },
+    {
+      name:  "display math may span lines",
+      input: "before\n$$\na = b\n$$\nafter",
+      want:  "before\n\x00MATH0\x00\nafter",
+      sources: []string{"\na = b\n"},
+      displays: []bool{true},
+    },
+    {
+      name:    "escaped dollar is left alone",
+      input:   `cost is \$5\$ exactly`,
+      want:    `cost is \$5\$ exactly`,
+      sources: nil,
+    },
+    {
+      name:    "empty span is not math",
+      input:   "$$ plain",
+      want:    "$$ plain",
+      sources: nil,
+    },
+    {
+      name:    "leading/trailing whitespace disqualifies a span",
+      input:   "$ x$ and $x $",
+      want:    "$ x$ and $x $",
+      sources: nil,
+    },
+    {
+      name:    "inline math can't cross a newline",
+      input:   "$a\nb$",
+      want:    "$a\nb$",
+      sources: nil,
+    },
+    {
+      name:    "dollar inside an inline code span is not math",
+      input:   "the cost is `$5$` today",
+      want:    "the cost is `$5$` today",
+      sources: nil,
+    },
+    {
+      name:    "dollar inside a fenced code block is not math",
+      input:   "```\nlet price = $5$;\n```\n",
+      want:    "```\nlet price = $5$;\n```\n",
+      sources: nil,
+    },
+    {
+      name:  "math before and after a fenced block both extract",
+      input: "$a$\n```\n$b$\n```\n$c$",
+      want:  "\x00MATH0\x00\n```\n$b$\n```\n\x00MATH1\x00",
+      sources: []string{"a", "c"},
+      displays: []bool{false, false},
+    },
+  }
+
+  for _, testCase := range cases {
+    t.Run(testCase.name, func(t *testing.T) {
+      got, spans := extractMath([]byte(testCase.input))
+      if string(got) != testCase.want {
+        t.Fatalf("extractMath(%q) content = %q, want %q", testCase.input, got, testCase.want)
+      }
+      if len(spans) != len(testCase.sources) {
+        t.Fatalf("extractMath(%q) returned %d spans, want %d", testCase.input, len(spans), len(testCase.sources))
+      }
+      for i, span := range spans {
+        if span.source != testCase.sources[i] {
+          t.Errorf("span %d source = %q, want %q", i, span.source, testCase.sources[i])
+        }
+        if span.display != testCase.displays[i] {
+          t.Errorf("span %d display = %v, want %v", i, span.display, testCase.displays[i])
+        }
+      }
+    })
+  }
+}
+
+func TestSkipCodeSpan(t *testing.T) {
+  content := []byte("``a ` b`` rest")
+  end, ok := skipCodeSpan(content, 0)
+  if !ok {
+    t.Fatalf("skipCodeSpan(%q, 0) did not match a code span", content)
+  }
+  if got, want := string(content[:end]), "``a ` b``"; got != want {
+    t.Fatalf("skipCodeSpan matched %q, want %q", got, want)
+  }
+
+  if _, ok := skipCodeSpan([]byte("`unterminated"), 0); ok {
+    t.Fatalf("skipCodeSpan matched an unterminated backtick run")
+  }
+}
+
+func TestInjectMath(t *testing.T) {
+  rendered, spans := extractMath([]byte("$a^2$"))
+  html := string(injectMath(rendered, spans))
+  if !strings.Contains(html, `class="math inline"`) {
+    t.Fatalf("injectMath output missing inline math span: %q", html)
+  }
+}